@@ -24,73 +24,141 @@ import (
 	"io"
 	"net"
 	"net/http"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
-	"github.com/GoogleCloudPlatform/prometheus-engine/e2e/kubeutil"
+	"golang.org/x/net/websocket"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/discovery"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/portforward"
+	"k8s.io/client-go/transport"
 	"k8s.io/client-go/transport/spdy"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/GoogleCloudPlatform/prometheus-engine/e2e/kubeutil"
 )
 
-// wrappedConn simply wraps a net.Conn with an additional close function.
-type wrappedConn struct {
-	conn    net.Conn
-	closeFn func()
-}
+type writerFn func(p []byte) (n int, err error)
 
-func (c *wrappedConn) Read(b []byte) (n int, err error) {
-	return c.conn.Read(b)
+func (w *writerFn) Write(p []byte) (n int, err error) {
+	return (*w)(p)
 }
 
-func (c *wrappedConn) Write(b []byte) (n int, err error) {
-	return c.conn.Write(b)
+func writerFromFn(fn func(p []byte) (n int, err error)) io.Writer {
+	w := writerFn(fn)
+	return &w
 }
 
-func (c *wrappedConn) Close() error {
-	err := c.conn.Close()
-	c.closeFn()
-	return err
-}
+// Protocol selects the transport PortForwardClient uses to establish
+// port-forward connections to pods.
+type Protocol int
 
-func (c *wrappedConn) LocalAddr() net.Addr {
-	return c.conn.LocalAddr()
-}
+const (
+	// ProtocolAuto probes the API server's capabilities on the first dial and
+	// picks ProtocolWebSocket if it is supported, falling back to ProtocolSPDY
+	// otherwise. The probe result is cached for the lifetime of the client.
+	ProtocolAuto Protocol = iota
+	// ProtocolSPDY forces the legacy SPDY-based port-forward transport.
+	ProtocolSPDY
+	// ProtocolWebSocket forces the WebSocket-based port-forward transport,
+	// i.e. the "v5.portforward.k8s.io" subprotocol.
+	ProtocolWebSocket
+)
 
-func (c *wrappedConn) RemoteAddr() net.Addr {
-	return c.conn.RemoteAddr()
-}
+// DialMode selects how PortForwardClient reaches pods.
+type DialMode int
+
+const (
+	// ModeAuto performs a one-time reachability probe against the cluster's
+	// kubernetes.default Service and picks ModeDirect if the test runner can
+	// reach it, falling back to ModePortForward otherwise. The probe result
+	// is cached for the lifetime of the client.
+	ModeAuto DialMode = iota
+	// ModePortForward routes every dial through a port-forward.
+	ModePortForward
+	// ModeDirect skips port-forwarding and dials the pod's IP directly. Only
+	// usable when the test runner has network access to the cluster (e.g.
+	// tests running in-cluster, kind with host networking, or over a VPN).
+	ModeDirect
+)
+
+// Option configures PortForwardClient.
+type Option func(*portForwardConfig)
 
-func (c *wrappedConn) SetDeadline(t time.Time) error {
-	return c.conn.SetDeadline(t)
+type portForwardConfig struct {
+	protocol Protocol
+	dialMode DialMode
 }
 
-func (c *wrappedConn) SetReadDeadline(t time.Time) error {
-	return c.conn.SetReadDeadline(t)
+// WithDialMode selects how PortForwardClient reaches pods. The default is
+// ModePortForward.
+func WithDialMode(m DialMode) Option {
+	return func(c *portForwardConfig) {
+		c.dialMode = m
+	}
 }
 
-func (c *wrappedConn) SetWriteDeadline(t time.Time) error {
-	return c.conn.SetWriteDeadline(t)
+// WithProtocol selects the transport PortForwardClient uses to establish
+// port-forward connections. The default is ProtocolAuto.
+func WithProtocol(p Protocol) Option {
+	return func(c *portForwardConfig) {
+		c.protocol = p
+	}
 }
 
-type writerFn func(p []byte) (n int, err error)
+// protocolCache resolves ProtocolAuto to a concrete protocol on first use and
+// caches the result so that later dials don't re-probe the API server.
+type protocolCache struct {
+	requested Protocol
 
-func (w *writerFn) Write(p []byte) (n int, err error) {
-	return (*w)(p)
+	once     sync.Once
+	resolved Protocol
+	err      error
 }
 
-func writerFromFn(fn func(p []byte) (n int, err error)) io.Writer {
-	w := writerFn(fn)
-	return &w
+func (c *protocolCache) resolve(restConfig *rest.Config) (Protocol, error) {
+	if c.requested != ProtocolAuto {
+		return c.requested, nil
+	}
+	c.once.Do(func() {
+		c.resolved, c.err = probeProtocol(restConfig)
+	})
+	return c.resolved, c.err
+}
+
+// probeProtocol checks whether the API server supports the WebSocket
+// port-forward subprotocol (GA as of Kubernetes 1.30). If the check itself
+// fails, we fall back to the universally-supported SPDY transport rather
+// than failing the dial outright.
+func probeProtocol(restConfig *rest.Config) (Protocol, error) {
+	disco, err := discovery.NewDiscoveryClientForConfig(restConfig)
+	if err != nil {
+		return ProtocolSPDY, nil
+	}
+	v, err := disco.ServerVersion()
+	if err != nil {
+		return ProtocolSPDY, nil
+	}
+	major, errMajor := strconv.Atoi(v.Major)
+	minor, errMinor := strconv.Atoi(strings.TrimRight(v.Minor, "+"))
+	if errMajor != nil || errMinor != nil {
+		return ProtocolSPDY, nil
+	}
+	if major > 1 || (major == 1 && minor >= 30) {
+		return ProtocolWebSocket, nil
+	}
+	return ProtocolSPDY, nil
 }
 
 // PortForwardClient returns a client that ports-forward all Kubernetes-local HTTP requests to the host.
-func PortForwardClient(t testing.TB, restConfig *rest.Config, kubeClient client.Client) (*http.Client, error) {
-	restClient, err := rest.RESTClientFor(restConfig)
+func PortForwardClient(t testing.TB, restConfig *rest.Config, kubeClient client.Client, opts ...Option) (*http.Client, error) {
+	dialer, err := NewDialer(t, restConfig, kubeClient, opts...)
 	if err != nil {
-		return nil, fmt.Errorf("unable to create REST client: %w", err)
+		return nil, err
 	}
 
 	return &http.Client{
@@ -108,91 +176,674 @@ func PortForwardClient(t testing.TB, restConfig *rest.Config, kubeClient client.
 				if err != nil {
 					return nil, fmt.Errorf("unable to get pod from IP %s: %w", addr.IP, err)
 				}
-				if err := kubeutil.WaitForPodContainerReady(ctx, t, restConfig, kubeClient, pod, container); err != nil {
-					return nil, fmt.Errorf("failed waiting for pod from IP %s: %w", addr.IP, err)
-				}
-				resourceURL := restClient.
-					Post().
-					Resource("pods").
-					Namespace(pod.GetNamespace()).
-					Name(pod.GetName()).
-					SubResource("portforward").
-					URL()
-
-				transport, upgrader, err := spdy.RoundTripperFor(restConfig)
-				if err != nil {
-					return nil, err
-				}
-				client := &http.Client{
-					Transport: transport,
-				}
+				return dialer.dialPodContainer(ctx, pod, container, int32(addr.Port))
+			},
+		},
+	}, nil
+}
 
-				stopCh := make(chan struct{})
-				readyCh := make(chan struct{})
-				errCh := make(chan error)
-				forwardDialer := spdy.NewDialer(upgrader, client, http.MethodPost, resourceURL)
-				forwarder, err := portforward.NewOnAddresses(
-					forwardDialer,
-					// Specify IPv4 address explicitly, since GitHub Actions does not support IPv6.
-					[]string{"127.0.0.1"},
-					// The leading colon indicates that a random port is chosen.
-					[]string{fmt.Sprintf(":%d", addr.Port)},
-					stopCh,
-					readyCh,
-					writerFromFn(func(p []byte) (n int, err error) {
-						t.Log(strings.TrimRight(string(p), " \n"))
-						return len(p), nil
-					}),
-					writerFromFn(func(p []byte) (n int, err error) {
-						t.Error(strings.TrimRight(string(p), " \n"))
-						return len(p), nil
-					}),
-				)
-				if err != nil {
-					return nil, err
-				}
+// Dialer establishes connections to pods and services in a Kubernetes
+// cluster, either directly or through a port-forward depending on DialMode.
+// SPDY port-forwards are pooled and reused per pod:port; WebSocket
+// port-forwards and direct connections are opened fresh for every dial (see
+// usesForwarderPool). This mirrors the kubernetes.Client.DialPod
+// pattern, but works against any *rest.Config/client.Client pair so that
+// PortForwardClient's http.Client and non-HTTP e2e tests (gRPC, raw TCP) can
+// share the same dial machinery instead of duplicating the port-forward
+// plumbing.
+type Dialer struct {
+	t          testing.TB
+	restConfig *rest.Config
+	restClient rest.Interface
+	kubeClient client.Client
 
-				go func() {
-					if err := forwarder.ForwardPorts(); err != nil {
-						errCh <- err
-					}
-				}()
+	protocols *protocolCache
+	dialModes *dialModeCache
+	pool      *forwarderPool
+}
 
-				close := func() {
-					// readyCh is closed by the port-forwarder.
-					close(stopCh)
-					close(errCh)
-				}
+// NewDialer constructs a Dialer for the given cluster.
+func NewDialer(t testing.TB, restConfig *rest.Config, kubeClient client.Client, opts ...Option) (*Dialer, error) {
+	cfg := portForwardConfig{protocol: ProtocolAuto, dialMode: ModePortForward}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
 
-				select {
-				case <-readyCh:
-					ports, err := forwarder.GetPorts()
-					if err != nil {
-						return nil, err
-					}
-					if len(ports) != 1 {
-						return nil, fmt.Errorf("expected 1 port but found %d", len(ports))
-					}
-					port := ports[0]
-
-					// Pass in tcp4 to ensure we always get IPv4 and never IPv6.
-					var dialer net.Dialer
-					conn, err := dialer.DialContext(ctx, "tcp4", fmt.Sprintf("127.0.0.1:%d", port.Local))
-					if err != nil {
-						return nil, err
-					}
-					return &wrappedConn{
-						conn:    conn,
-						closeFn: close,
-					}, nil
-				case <-stopCh:
-					close()
-					return nil, fmt.Errorf("port forwarding stopped unexpectedly")
-				case err := <-errCh:
-					close()
-					return nil, fmt.Errorf("port forwarding failed: %w", err)
-				}
-			},
-		},
+	restClient, err := rest.RESTClientFor(restConfig)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create REST client: %w", err)
+	}
+
+	return &Dialer{
+		t:          t,
+		restConfig: restConfig,
+		restClient: restClient,
+		kubeClient: kubeClient,
+		protocols:  &protocolCache{requested: cfg.protocol},
+		dialModes:  &dialModeCache{requested: cfg.dialMode},
+		pool:       newForwarderPool(t),
 	}, nil
 }
+
+// DialPod dials the given container port of the pod namespace/name.
+func (d *Dialer) DialPod(ctx context.Context, namespace, name string, port int32) (net.Conn, error) {
+	pod := &corev1.Pod{}
+	if err := d.kubeClient.Get(ctx, client.ObjectKey{Namespace: namespace, Name: name}, pod); err != nil {
+		return nil, fmt.Errorf("unable to get pod %s/%s: %w", namespace, name, err)
+	}
+	return d.dialPodContainer(ctx, pod, containerForPort(pod, port), port)
+}
+
+// DialService resolves the named Service's port to a ready backing pod and
+// dials it.
+func (d *Dialer) DialService(ctx context.Context, namespace, name string, port int32) (net.Conn, error) {
+	svc := &corev1.Service{}
+	if err := d.kubeClient.Get(ctx, client.ObjectKey{Namespace: namespace, Name: name}, svc); err != nil {
+		return nil, fmt.Errorf("unable to get service %s/%s: %w", namespace, name, err)
+	}
+	portName, err := servicePortName(svc, port)
+	if err != nil {
+		return nil, err
+	}
+
+	// Resolve through Endpoints rather than re-deriving backing pods from
+	// svc.Spec.Selector: a headless Service with manually-managed Endpoints
+	// (or an ExternalName Service) may have no selector at all, and matching
+	// pods by a nil/empty selector would silently hit an arbitrary pod in the
+	// namespace instead of failing loudly.
+	endpoints := &corev1.Endpoints{}
+	if err := d.kubeClient.Get(ctx, client.ObjectKey{Namespace: namespace, Name: name}, endpoints); err != nil {
+		return nil, fmt.Errorf("unable to get endpoints for service %s/%s: %w", namespace, name, err)
+	}
+
+	for _, subset := range endpoints.Subsets {
+		targetPort, ok := targetPortForName(subset, portName)
+		if !ok {
+			continue
+		}
+		// EndpointSubset.Addresses only ever holds ready addresses; pending
+		// ones live in NotReadyAddresses, so there's no separate readiness
+		// check needed here.
+		for _, addr := range subset.Addresses {
+			if addr.TargetRef == nil || addr.TargetRef.Kind != "Pod" {
+				continue
+			}
+			pod := &corev1.Pod{}
+			if err := d.kubeClient.Get(ctx, client.ObjectKey{Namespace: addr.TargetRef.Namespace, Name: addr.TargetRef.Name}, pod); err != nil {
+				continue
+			}
+			return d.dialPodContainer(ctx, pod, containerForPort(pod, targetPort), targetPort)
+		}
+	}
+	return nil, fmt.Errorf("no ready endpoints backing service %s/%s port %d", namespace, name, port)
+}
+
+// dialPodContainer waits for container (or, if empty, all containers) on pod
+// to be ready and then establishes a connection to port, routing through the
+// resolved DialMode and Protocol and the forwarder pool.
+func (d *Dialer) dialPodContainer(ctx context.Context, pod *corev1.Pod, container string, port int32) (net.Conn, error) {
+	if err := kubeutil.WaitForPodContainerReady(ctx, d.t, d.restConfig, d.kubeClient, pod, container); err != nil {
+		return nil, fmt.Errorf("failed waiting for pod %s/%s: %w", pod.GetNamespace(), pod.GetName(), err)
+	}
+
+	mode, err := d.dialModes.resolve(ctx, d.kubeClient)
+	if err != nil {
+		return nil, fmt.Errorf("unable to determine dial mode: %w", err)
+	}
+	if mode == ModeDirect {
+		return dialDirect(ctx, pod, int(port))
+	}
+
+	protocol, err := d.protocols.resolve(d.restConfig)
+	if err != nil {
+		return nil, fmt.Errorf("unable to determine port-forward protocol: %w", err)
+	}
+	if !usesForwarderPool(protocol) {
+		return dialPortForwardWebSocket(d.restConfig, d.restClient, pod, int(port))
+	}
+
+	key := forwarderKey{namespace: pod.GetNamespace(), pod: pod.GetName(), port: int(port)}
+	return d.pool.dial(ctx, key, func() (pooledForwarder, error) {
+		return newSPDYForwarder(d.t, d.restConfig, d.restClient, pod, int(port))
+	})
+}
+
+// usesForwarderPool reports whether protocol routes its dials through the
+// forwarder pool. Only SPDY does: its PortForwarder can multiplex any number
+// of local connections onto one forwarder, whereas the WebSocket transport's
+// per-session channel set is fixed at upgrade time, so every WebSocket dial
+// needs its own connection (see dialPortForwardWebSocket) and never reuses
+// one from the pool.
+//
+// ProtocolAuto resolves to ProtocolWebSocket on any apiserver that's GA for
+// the subprotocol (Kubernetes 1.30+, see probeProtocol) — i.e. most clusters
+// this suite runs against today — so under the default configuration most
+// dials take this path and the forwarder pool's benefit is limited to
+// callers that pin WithProtocol(ProtocolSPDY) or run against older clusters.
+func usesForwarderPool(protocol Protocol) bool {
+	return protocol == ProtocolSPDY
+}
+
+// containerForPort returns the name of the pod container that declares port
+// as one of its container ports, falling back to "" (wait for all
+// containers) if none does.
+func containerForPort(pod *corev1.Pod, port int32) string {
+	for _, c := range pod.Spec.Containers {
+		for _, p := range c.Ports {
+			if p.ContainerPort == port {
+				return c.Name
+			}
+		}
+	}
+	return ""
+}
+
+// servicePortName returns the name of svc's port, which may be empty for a
+// Service with a single unnamed port.
+func servicePortName(svc *corev1.Service, port int32) (string, error) {
+	for _, p := range svc.Spec.Ports {
+		if p.Port == port {
+			return p.Name, nil
+		}
+	}
+	return "", fmt.Errorf("service %s/%s has no port %d", svc.Namespace, svc.Name, port)
+}
+
+// targetPortForName returns the target port in subset matching portName and
+// whether one was found. Endpoints resolve a Service port (including named
+// target ports) to a concrete container port per subset, matched by name.
+func targetPortForName(subset corev1.EndpointSubset, portName string) (int32, bool) {
+	for _, p := range subset.Ports {
+		if p.Name == portName {
+			return p.Port, true
+		}
+	}
+	return 0, false
+}
+
+// dialModeCache resolves ModeAuto to a concrete mode on first use and caches
+// the result so that later dials don't re-probe the cluster.
+type dialModeCache struct {
+	requested DialMode
+
+	once     sync.Once
+	resolved DialMode
+	err      error
+}
+
+func (c *dialModeCache) resolve(ctx context.Context, kubeClient client.Client) (DialMode, error) {
+	if c.requested != ModeAuto {
+		return c.requested, nil
+	}
+	c.once.Do(func() {
+		c.resolved, c.err = probeDialMode(ctx, kubeClient)
+	})
+	return c.resolved, c.err
+}
+
+// probeDialMode checks whether the test runner can reach the cluster network
+// directly by dialing the well-known kubernetes.default Service. If the
+// Service can't even be looked up, we fall back to ModePortForward rather
+// than failing the dial outright.
+func probeDialMode(ctx context.Context, kubeClient client.Client) (DialMode, error) {
+	svc := &corev1.Service{}
+	if err := kubeClient.Get(ctx, client.ObjectKey{Namespace: "default", Name: "kubernetes"}, svc); err != nil {
+		return ModePortForward, nil
+	}
+	if svc.Spec.ClusterIP == "" || len(svc.Spec.Ports) == 0 {
+		return ModePortForward, nil
+	}
+
+	probeCtx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(probeCtx, "tcp", net.JoinHostPort(svc.Spec.ClusterIP, strconv.Itoa(int(svc.Spec.Ports[0].Port))))
+	if err != nil {
+		return ModePortForward, nil
+	}
+	conn.Close()
+	return ModeDirect, nil
+}
+
+// dialDirect dials the pod's IP directly, bypassing port-forwarding
+// entirely. Only safe to use when the test runner already has network access
+// to the cluster.
+func dialDirect(ctx context.Context, pod *corev1.Pod, port int) (net.Conn, error) {
+	if pod.Status.PodIP == "" {
+		return nil, fmt.Errorf("pod %s/%s has no IP assigned", pod.GetNamespace(), pod.GetName())
+	}
+	var dialer net.Dialer
+	return dialer.DialContext(ctx, "tcp", net.JoinHostPort(pod.Status.PodIP, strconv.Itoa(port)))
+}
+
+// forwarderIdleTimeout is how long a pooled forwarder may sit unreferenced
+// before forwarderPool tears it down.
+const forwarderIdleTimeout = 2 * time.Minute
+
+// forwarderKey identifies a single pod container port that a forwarder in
+// the pool forwards to.
+type forwarderKey struct {
+	namespace string
+	pod       string
+	port      int
+}
+
+// pooledForwarder is a long-lived port-forwarder that can hand out new
+// logical connections to the same pod:port without repeating the REST POST
+// and transport upgrade handshake on every dial. SPDY is the only transport
+// that implements it: its portforward.PortForwarder accepts any number of
+// local connections and opens a fresh SPDY stream pair per one, whereas the
+// WebSocket transport's channel set is fixed for the lifetime of a session
+// (see dialPortForwardWebSocket), so it dials a fresh connection every time
+// instead of going through the pool.
+type pooledForwarder interface {
+	// dial returns a new net.Conn to the forwarded pod:port.
+	dial(ctx context.Context) (net.Conn, error)
+	// healthy reports whether the underlying forwarder is still usable.
+	healthy() bool
+	// close tears down the forwarder.
+	close()
+}
+
+type poolEntry struct {
+	forwarder pooledForwarder
+	refs      int
+	lastUsed  time.Time
+}
+
+// forwarderPool caches live pooledForwarders keyed by pod:containerPort, so
+// that a test hammering the same pod:port over SPDY reuses one forwarder
+// instead of paying for a fresh port-forward setup on every HTTP request.
+// Entries are reference-counted and evicted once idle for
+// forwarderIdleTimeout, and are recreated transparently if the underlying
+// forwarder reports itself unhealthy (e.g. its stream died).
+type forwarderPool struct {
+	mu      sync.Mutex
+	entries map[forwarderKey]*poolEntry
+
+	// inflight holds a channel per key currently being created, so that
+	// concurrent dials for the same key wait on one another instead of
+	// calling create more than once.
+	inflight map[forwarderKey]chan struct{}
+}
+
+func newForwarderPool(t testing.TB) *forwarderPool {
+	p := &forwarderPool{
+		entries:  make(map[forwarderKey]*poolEntry),
+		inflight: make(map[forwarderKey]chan struct{}),
+	}
+	stopCh := make(chan struct{})
+	t.Cleanup(func() {
+		close(stopCh)
+		p.closeAll()
+	})
+	go p.evictLoop(stopCh)
+	return p
+}
+
+// dial returns a connection to the forwarder for key, creating it via create
+// if it doesn't exist yet or the cached one is no longer healthy.
+func (p *forwarderPool) dial(ctx context.Context, key forwarderKey, create func() (pooledForwarder, error)) (net.Conn, error) {
+	entry, err := p.acquire(key, create)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := entry.forwarder.dial(ctx)
+	if err != nil {
+		p.mu.Lock()
+		entry.refs--
+		p.mu.Unlock()
+		return nil, err
+	}
+
+	var released sync.Once
+	release := func() {
+		released.Do(func() {
+			p.mu.Lock()
+			entry.refs--
+			entry.lastUsed = time.Now()
+			p.mu.Unlock()
+		})
+	}
+	return &pooledConn{Conn: conn, release: release}, nil
+}
+
+// acquire returns the refcounted pool entry for key, incrementing its
+// refcount, creating it via create if it doesn't exist yet or the cached one
+// is no longer healthy. create runs without holding p.mu so that a slow
+// create (a REST POST plus transport upgrade, for the SPDY path) for one key
+// never blocks concurrent dials for other keys. Creation per key is
+// singleflighted: if another goroutine is already creating the entry for
+// key, acquire waits for it to finish rather than calling create again.
+func (p *forwarderPool) acquire(key forwarderKey, create func() (pooledForwarder, error)) (*poolEntry, error) {
+	for {
+		p.mu.Lock()
+		if entry, ok := p.entries[key]; ok {
+			if !entry.forwarder.healthy() {
+				entry.forwarder.close()
+				delete(p.entries, key)
+				p.mu.Unlock()
+				continue
+			}
+			entry.refs++
+			entry.lastUsed = time.Now()
+			p.mu.Unlock()
+			return entry, nil
+		}
+		if done, ok := p.inflight[key]; ok {
+			p.mu.Unlock()
+			<-done
+			continue
+		}
+		done := make(chan struct{})
+		p.inflight[key] = done
+		p.mu.Unlock()
+
+		fwd, err := create()
+
+		p.mu.Lock()
+		delete(p.inflight, key)
+		if err != nil {
+			p.mu.Unlock()
+			close(done)
+			return nil, err
+		}
+		entry := &poolEntry{forwarder: fwd, refs: 1, lastUsed: time.Now()}
+		p.entries[key] = entry
+		p.mu.Unlock()
+		close(done)
+		return entry, nil
+	}
+}
+
+func (p *forwarderPool) evictLoop(stopCh <-chan struct{}) {
+	ticker := time.NewTicker(forwarderIdleTimeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C:
+			p.evictIdle()
+		}
+	}
+}
+
+func (p *forwarderPool) evictIdle() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for key, entry := range p.entries {
+		if entry.refs == 0 && time.Since(entry.lastUsed) > forwarderIdleTimeout {
+			entry.forwarder.close()
+			delete(p.entries, key)
+		}
+	}
+}
+
+func (p *forwarderPool) closeAll() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for key, entry := range p.entries {
+		entry.forwarder.close()
+		delete(p.entries, key)
+	}
+}
+
+// pooledConn decrements its pool entry's reference count exactly once, on
+// the first Close, regardless of how many times Close is called.
+type pooledConn struct {
+	net.Conn
+	release func()
+}
+
+func (c *pooledConn) Close() error {
+	err := c.Conn.Close()
+	c.release()
+	return err
+}
+
+// spdyForwarder is a long-lived SPDY port-forwarder for a single pod:port.
+// Each call to dial just opens a new TCP connection to its already-running
+// local listener.
+type spdyForwarder struct {
+	localPort int
+	stopCh    chan struct{}
+
+	mu   sync.Mutex
+	dead bool
+}
+
+func newSPDYForwarder(t testing.TB, restConfig *rest.Config, restClient rest.Interface, pod *corev1.Pod, port int) (*spdyForwarder, error) {
+	resourceURL := restClient.
+		Post().
+		Resource("pods").
+		Namespace(pod.GetNamespace()).
+		Name(pod.GetName()).
+		SubResource("portforward").
+		URL()
+
+	roundTripper, upgrader, err := spdy.RoundTripperFor(restConfig)
+	if err != nil {
+		return nil, err
+	}
+	client := &http.Client{
+		Transport: roundTripper,
+	}
+
+	stopCh := make(chan struct{})
+	readyCh := make(chan struct{})
+	errCh := make(chan error, 1)
+	forwardDialer := spdy.NewDialer(upgrader, client, http.MethodPost, resourceURL)
+	forwarder, err := portforward.NewOnAddresses(
+		forwardDialer,
+		// Specify IPv4 address explicitly, since GitHub Actions does not support IPv6.
+		[]string{"127.0.0.1"},
+		// The leading colon indicates that a random port is chosen.
+		[]string{fmt.Sprintf(":%d", port)},
+		stopCh,
+		readyCh,
+		writerFromFn(func(p []byte) (n int, err error) {
+			t.Log(strings.TrimRight(string(p), " \n"))
+			return len(p), nil
+		}),
+		writerFromFn(func(p []byte) (n int, err error) {
+			t.Error(strings.TrimRight(string(p), " \n"))
+			return len(p), nil
+		}),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	f := &spdyForwarder{stopCh: stopCh}
+	go func() {
+		err := forwarder.ForwardPorts()
+		f.mu.Lock()
+		f.dead = true
+		f.mu.Unlock()
+		if err != nil {
+			select {
+			case errCh <- err:
+			default:
+			}
+		}
+	}()
+
+	select {
+	case <-readyCh:
+		ports, err := forwarder.GetPorts()
+		if err != nil {
+			close(stopCh)
+			return nil, err
+		}
+		if len(ports) != 1 {
+			close(stopCh)
+			return nil, fmt.Errorf("expected 1 port but found %d", len(ports))
+		}
+		f.localPort = int(ports[0].Local)
+		return f, nil
+	case <-stopCh:
+		return nil, fmt.Errorf("port forwarding stopped unexpectedly")
+	case err := <-errCh:
+		return nil, fmt.Errorf("port forwarding failed: %w", err)
+	}
+}
+
+func (f *spdyForwarder) dial(ctx context.Context) (net.Conn, error) {
+	// Pass in tcp4 to ensure we always get IPv4 and never IPv6.
+	var dialer net.Dialer
+	return dialer.DialContext(ctx, "tcp4", fmt.Sprintf("127.0.0.1:%d", f.localPort))
+}
+
+func (f *spdyForwarder) healthy() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return !f.dead
+}
+
+func (f *spdyForwarder) close() {
+	close(f.stopCh)
+}
+
+// portForwardWebSocketSubprotocol is the apiserver subprotocol that carries
+// port-forward traffic over a WebSocket connection.
+const portForwardWebSocketSubprotocol = "v5.portforward.k8s.io"
+
+// wsPortForwardDataChannel and wsPortForwardErrorChannel are the channel IDs
+// the apiserver assigns to the (single) port requested via the "ports" query
+// parameter, in request order, before the WebSocket upgrade completes.
+// Unlike SPDY's SYN_STREAM headers, the v5.portforward.k8s.io subprotocol
+// has no way to negotiate additional channels after the handshake, so this
+// connection only ever carries one pod:port session.
+const (
+	wsPortForwardDataChannel  byte = 0
+	wsPortForwardErrorChannel byte = 1
+)
+
+// dialPortForwardWebSocket establishes a new port-forward connection to
+// pod:port using the WebSocket-based v5.portforward.k8s.io subprotocol. The
+// target port is conveyed via the "ports" query parameter so the apiserver
+// can set up the data/error channel pair before completing the upgrade;
+// because that channel set is fixed at upgrade time, each call opens its own
+// WebSocket session rather than reusing one across dials.
+func dialPortForwardWebSocket(restConfig *rest.Config, restClient rest.Interface, pod *corev1.Pod, port int) (net.Conn, error) {
+	resourceURL := restClient.
+		Post().
+		Resource("pods").
+		Namespace(pod.GetNamespace()).
+		Name(pod.GetName()).
+		SubResource("portforward").
+		Param("ports", strconv.Itoa(port)).
+		URL()
+
+	wsURL := *resourceURL
+	if wsURL.Scheme == "https" {
+		wsURL.Scheme = "wss"
+	} else {
+		wsURL.Scheme = "ws"
+	}
+
+	tlsConfig, err := transport.TLSConfigFor(restConfig)
+	if err != nil {
+		return nil, fmt.Errorf("unable to build TLS config: %w", err)
+	}
+
+	wsConfig, err := websocket.NewConfig(wsURL.String(), "http://localhost")
+	if err != nil {
+		return nil, fmt.Errorf("unable to build websocket config: %w", err)
+	}
+	wsConfig.Protocol = []string{portForwardWebSocketSubprotocol}
+	wsConfig.TlsConfig = tlsConfig
+	if restConfig.BearerToken != "" {
+		wsConfig.Header = http.Header{"Authorization": []string{"Bearer " + restConfig.BearerToken}}
+	}
+
+	ws, err := websocket.DialConfig(wsConfig)
+	if err != nil {
+		return nil, fmt.Errorf("unable to dial websocket port-forward: %w", err)
+	}
+	return newWSPortForwardConn(ws), nil
+}
+
+// wsPortForwardConn adapts a single-port v5.portforward.k8s.io WebSocket
+// session to a net.Conn: frames on the data channel are returned from Read,
+// and a frame on the error channel is surfaced as a sticky error from Read.
+type wsPortForwardConn struct {
+	ws *websocket.Conn
+
+	mu      sync.Mutex
+	buf     []byte
+	readErr error
+}
+
+func newWSPortForwardConn(ws *websocket.Conn) *wsPortForwardConn {
+	return &wsPortForwardConn{ws: ws}
+}
+
+func (c *wsPortForwardConn) Read(b []byte) (int, error) {
+	c.mu.Lock()
+	if len(c.buf) > 0 {
+		n := copy(b, c.buf)
+		c.buf = c.buf[n:]
+		c.mu.Unlock()
+		return n, nil
+	}
+	if c.readErr != nil {
+		err := c.readErr
+		c.mu.Unlock()
+		return 0, err
+	}
+	c.mu.Unlock()
+
+	for {
+		var frame []byte
+		if err := websocket.Message.Receive(c.ws, &frame); err != nil {
+			return 0, err
+		}
+		if len(frame) == 0 {
+			continue
+		}
+		if frame[0] == wsPortForwardErrorChannel {
+			c.mu.Lock()
+			c.readErr = fmt.Errorf("port forwarding failed: %s", frame[1:])
+			err := c.readErr
+			c.mu.Unlock()
+			return 0, err
+		}
+		n := copy(b, frame[1:])
+		if n < len(frame)-1 {
+			c.mu.Lock()
+			c.buf = append(c.buf, frame[1+n:]...)
+			c.mu.Unlock()
+		}
+		return n, nil
+	}
+}
+
+func (c *wsPortForwardConn) Write(b []byte) (int, error) {
+	frame := make([]byte, len(b)+1)
+	frame[0] = wsPortForwardDataChannel
+	copy(frame[1:], b)
+	if err := websocket.Message.Send(c.ws, frame); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *wsPortForwardConn) Close() error {
+	return c.ws.Close()
+}
+
+func (c *wsPortForwardConn) LocalAddr() net.Addr  { return c.ws.LocalAddr() }
+func (c *wsPortForwardConn) RemoteAddr() net.Addr { return c.ws.RemoteAddr() }
+
+func (c *wsPortForwardConn) SetDeadline(t time.Time) error {
+	if err := c.ws.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.ws.SetWriteDeadline(t)
+}
+
+func (c *wsPortForwardConn) SetReadDeadline(t time.Time) error  { return c.ws.SetReadDeadline(t) }
+func (c *wsPortForwardConn) SetWriteDeadline(t time.Time) error { return c.ws.SetWriteDeadline(t) }